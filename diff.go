@@ -0,0 +1,453 @@
+// Copyright (c) 2024 Firefly Consulting Ltd.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/fireflycons/yaml-merge/pkg/yamlmerge"
+)
+
+// parseDiffFormat parses the value of the -diff-format flag, returning
+// whether the diff should be written as JSON rather than the default
+// human-readable text.
+func parseDiffFormat(s string) (bool, error) {
+	switch s {
+	case "", "text":
+		return false, nil
+	case "json":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown diff format %q", s)
+	}
+}
+
+// diffSource names one merge input so diff records can report where a
+// value came from.
+type diffSource struct {
+	file string
+	node *yaml.Node
+}
+
+// diffLocation identifies a source file and line.
+type diffLocation struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+}
+
+// diffOverride describes a value that lost out to a later, higher-priority
+// source.
+type diffOverride struct {
+	File  string `json:"file"`
+	Line  int    `json:"line"`
+	Value string `json:"value"`
+}
+
+// diffRecord describes, for one path in the merged document, which source
+// contributed the winning value, which sources were overridden, and
+// whether the sources disagreed on the value's type.
+type diffRecord struct {
+	Path       string         `json:"path"`
+	Winner     diffLocation   `json:"winner"`
+	Overridden []diffOverride `json:"overridden,omitempty"`
+	Conflict   bool           `json:"conflict"`
+}
+
+// diffDocuments decodes each source and writes a structured diff to dest
+// describing which source contributed each value in the document(s) that
+// merger would have produced for the same inputs, honoring merger's
+// CaseInsensitive, SeqStrategy and DocMode settings and rejecting sources
+// merger would reject (e.g. on duplicate keys). It never writes the
+// merged document itself.
+func diffDocuments(names []string, toJson bool, merger yamlmerge.Merger, dest io.Writer, sources ...io.Reader) error {
+	perSource, err := merger.DecodeSources(sources)
+	if err != nil {
+		return err
+	}
+
+	if merger.DocMode == yamlmerge.DocModeStream {
+		return diffDocumentStream(names, perSource, toJson, merger, dest)
+	}
+
+	records, err := buildDiffRecords(flattenDiffSources(names, perSource), merger)
+	if err != nil {
+		return err
+	}
+
+	if toJson {
+		return writeDiffJSON(dest, records)
+	}
+	return writeDiffText(dest, records)
+}
+
+// flattenDiffSources lays out every document from every source, in the
+// same ascending-priority order MergeReaderNodes folds them in under
+// DocModeMerge (and DocModeFirst, where perSource already holds only each
+// source's first document). A source contributing more than one document
+// has each one labeled with its document number, so the diff can still
+// tell them apart.
+func flattenDiffSources(names []string, perSource [][]*yaml.Node) []diffSource {
+	var out []diffSource
+	for i, docs := range perSource {
+		for j, content := range docs {
+			label := names[i]
+			if len(docs) > 1 {
+				label = fmt.Sprintf("%s (doc %d)", names[i], j+1)
+			}
+			out = append(out, diffSource{file: label, node: content})
+		}
+	}
+	return out
+}
+
+// diffDocumentStream writes one diff, separated by "---", per paired
+// document index, mirroring mergeDocumentStreamNodes: a source with fewer
+// documents than the longest stream has its last document broadcast
+// across the remaining indices.
+func diffDocumentStream(names []string, perSource [][]*yaml.Node, toJson bool, merger yamlmerge.Merger, dest io.Writer) error {
+	docCount := 0
+	for _, docs := range perSource {
+		if len(docs) > docCount {
+			docCount = len(docs)
+		}
+	}
+
+	allRecords := make([][]diffRecord, 0, docCount)
+	for i := 0; i < docCount; i++ {
+		var diffSources []diffSource
+		for si, docs := range perSource {
+			if len(docs) == 0 {
+				continue
+			}
+			idx := i
+			if idx >= len(docs) {
+				idx = len(docs) - 1
+			}
+			diffSources = append(diffSources, diffSource{file: names[si], node: docs[idx]})
+		}
+
+		records, err := buildDiffRecords(diffSources, merger)
+		if err != nil {
+			return err
+		}
+		allRecords = append(allRecords, records)
+	}
+
+	if toJson {
+		enc := json.NewEncoder(dest)
+		enc.SetIndent("", "    ")
+		return enc.Encode(allRecords)
+	}
+
+	for i, records := range allRecords {
+		if i > 0 {
+			if _, err := fmt.Fprintln(dest, "---"); err != nil {
+				return err
+			}
+		}
+		if err := writeDiffText(dest, records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pathContribution is one source's node at a given path, in source
+// (ascending priority) order.
+type pathContribution struct {
+	file string
+	node *yaml.Node
+}
+
+// buildDiffRecords walks every source's document in lockstep, the same
+// way Merger would merge them, and reports for each leaf path (or path
+// where sources disagree on the value's shape) which source's value won
+// and which sources it overrode.
+func buildDiffRecords(sources []diffSource, merger yamlmerge.Merger) ([]diffRecord, error) {
+	contributions := make([]pathContribution, len(sources))
+	for i, s := range sources {
+		contributions[i] = pathContribution{file: s.file, node: s.node}
+	}
+
+	var records []diffRecord
+	if err := diffAtPath("", contributions, merger, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// diffAtPath resolves the diff record(s) for path given every source's
+// contribution there, in ascending priority order, recursing into
+// mapping and sequence children the same way Merger would merge them.
+func diffAtPath(path string, contributions []pathContribution, merger yamlmerge.Merger, out *[]diffRecord) error {
+	if len(contributions) == 0 {
+		return nil
+	}
+
+	winner := contributions[len(contributions)-1]
+
+	conflict := false
+	for _, c := range contributions[:len(contributions)-1] {
+		if c.node.Kind != winner.node.Kind {
+			conflict = true
+		}
+	}
+
+	if conflict || winner.node.Kind == yaml.ScalarNode {
+		emitDiffRecord(path, contributions, conflict, out)
+		return nil
+	}
+
+	if winner.node.Kind == yaml.MappingNode {
+		return diffMapping(path, contributions, merger, out)
+	}
+
+	return diffSequence(path, contributions, merger, out)
+}
+
+// emitDiffRecord appends the diff record for a leaf path (a scalar value,
+// or a path where sources disagree on shape).
+func emitDiffRecord(path string, contributions []pathContribution, conflict bool, out *[]diffRecord) {
+	winner := contributions[len(contributions)-1]
+	rec := diffRecord{
+		Path:     displayPath(path),
+		Winner:   diffLocation{File: winner.file, Line: winner.node.Line},
+		Conflict: conflict,
+	}
+	for _, c := range contributions[:len(contributions)-1] {
+		rec.Overridden = append(rec.Overridden, diffOverride{
+			File:  c.file,
+			Line:  c.node.Line,
+			Value: describeValue(c.node),
+		})
+	}
+	*out = append(*out, rec)
+}
+
+// diffMapping recurses into a mapping path's keys, grouping contributions
+// from every source by key (case-insensitively, when merger.CaseInsensitive
+// is set) the same way mergeMappingNode would, with each group's display
+// casing taken from its highest-priority contributor.
+func diffMapping(path string, contributions []pathContribution, merger yamlmerge.Merger, out *[]diffRecord) error {
+	type keyGroup struct {
+		display string
+		subs    []pathContribution
+	}
+	var order []string
+	groups := make(map[string]*keyGroup)
+
+	for _, c := range contributions {
+		if c.node.Kind != yaml.MappingNode {
+			continue
+		}
+		for i := 0; i < len(c.node.Content); i += 2 {
+			key, val := c.node.Content[i], c.node.Content[i+1]
+			norm := key.Value
+			if merger.CaseInsensitive {
+				norm = strings.ToLower(norm)
+			}
+			g, ok := groups[norm]
+			if !ok {
+				g = &keyGroup{}
+				groups[norm] = g
+				order = append(order, norm)
+			}
+			// Higher-priority source's casing wins, matching mergeMappingNode.
+			g.display = key.Value
+			g.subs = append(g.subs, pathContribution{file: c.file, node: val})
+		}
+	}
+
+	for _, norm := range order {
+		g := groups[norm]
+		if err := diffAtPath(joinPath(path, g.display), g.subs, merger, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seqSlot tracks, for one position in a sequence being folded by
+// diffSequence, every surviving contribution that landed there, in
+// ascending priority order — a keyed-merge match can accumulate more than
+// one, the same way mergeMappingNode would deep-merge them.
+type seqSlot struct {
+	contribs []pathContribution
+}
+
+// diffSequence resolves the diff record(s) for a sequence path by folding
+// contributions hop by hop in ascending priority order, exactly the way
+// Merger.mergeSequenceNode would: each hop's own node picks the strategy
+// for that hop (a per-node `!merge:<strategy>` tag or comment still
+// overrides merger's default), so a SeqReplace hop discards everything
+// accumulated before it rather than being silently assumed impossible.
+// Non-discarding strategies (append/prepend/unique/merge-by) fold into
+// per-index slots that are then recursed into via diffAtPath, so a
+// merge-by match's fields are diffed just like any other mapping.
+func diffSequence(path string, contributions []pathContribution, merger yamlmerge.Merger, out *[]diffRecord) error {
+	newSlots := func(c pathContribution) []seqSlot {
+		slots := make([]seqSlot, 0, len(c.node.Content))
+		for _, item := range c.node.Content {
+			slots = append(slots, seqSlot{contribs: []pathContribution{{file: c.file, node: item}}})
+		}
+		return slots
+	}
+
+	alive := []pathContribution{contributions[0]}
+	slots := newSlots(contributions[0])
+
+	for _, c := range contributions[1:] {
+		strategy, err := yamlmerge.NodeSeqStrategy(c.node, merger.SeqStrategy)
+		if err != nil {
+			return err
+		}
+
+		if strategy.Mode == yamlmerge.SeqReplace {
+			// Mirrors mergeSequenceNode's default case: the lower-priority
+			// sequence (everything folded in so far) is discarded entirely,
+			// not overridden item-by-item.
+			if len(alive) > 0 {
+				rec := diffRecord{Path: displayPath(path), Winner: diffLocation{File: c.file, Line: c.node.Line}}
+				for _, a := range alive {
+					rec.Overridden = append(rec.Overridden, diffOverride{File: a.file, Line: a.node.Line, Value: describeValue(a.node)})
+				}
+				*out = append(*out, rec)
+			}
+			alive = []pathContribution{c}
+			slots = newSlots(c)
+			continue
+		}
+
+		alive = append(alive, c)
+
+		switch strategy.Mode {
+		case yamlmerge.SeqAppend:
+			slots = append(slots, newSlots(c)...)
+		case yamlmerge.SeqPrepend:
+			slots = append(newSlots(c), slots...)
+		case yamlmerge.SeqUnique:
+			// Like dedupeSequence, drop every item deep-equal to an earlier
+			// one, lower-priority items included.
+			var deduped []seqSlot
+			for _, s := range append(slots, newSlots(c)...) {
+				dup := false
+				for _, d := range deduped {
+					if yamlmerge.NodesEqual(d.contribs[len(d.contribs)-1].node, s.contribs[len(s.contribs)-1].node) {
+						dup = true
+						break
+					}
+				}
+				if !dup {
+					deduped = append(deduped, s)
+				}
+			}
+			slots = deduped
+		case yamlmerge.SeqKeyedMerge:
+			for _, item := range c.node.Content {
+				idx := -1
+				if itemKey, ok := yamlmerge.MappingKeyValue(item, strategy.Key, merger.CaseInsensitive); ok {
+					for i, s := range slots {
+						cur := s.contribs[len(s.contribs)-1].node
+						if curKey, ok := yamlmerge.MappingKeyValue(cur, strategy.Key, merger.CaseInsensitive); ok && curKey == itemKey {
+							idx = i
+							break
+						}
+					}
+				}
+				if idx < 0 {
+					slots = append(slots, seqSlot{contribs: []pathContribution{{file: c.file, node: item}}})
+					continue
+				}
+				slots[idx].contribs = append(slots[idx].contribs, pathContribution{file: c.file, node: item})
+			}
+		}
+	}
+
+	for i, s := range slots {
+		if err := diffAtPath(fmt.Sprintf("%s[%d]", path, i), s.contribs, merger, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// joinPath appends key to a dotted path, treating the empty (root) path
+// specially.
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// displayPath returns the human-visible form of the root path.
+func displayPath(path string) string {
+	if path == "" {
+		return "."
+	}
+	return path
+}
+
+// describeValue renders a node for display in an "overridden" entry.
+func describeValue(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		return n.Value
+	case yaml.MappingNode:
+		return fmt.Sprintf("{%d keys}", len(n.Content)/2)
+	case yaml.SequenceNode:
+		return fmt.Sprintf("[%d items]", len(n.Content))
+	default:
+		return "unknown"
+	}
+}
+
+func writeDiffText(w io.Writer, records []diffRecord) error {
+	for _, r := range records {
+		suffix := ""
+		if r.Conflict {
+			suffix = " (type conflict)"
+		}
+		if _, err := fmt.Fprintf(w, "%s%s\n", r.Path, suffix); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "  winner: %s:%d\n", r.Winner.File, r.Winner.Line); err != nil {
+			return err
+		}
+		for _, o := range r.Overridden {
+			if _, err := fmt.Fprintf(w, "  overridden: %s:%d = %s\n", o.File, o.Line, o.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeDiffJSON(w io.Writer, records []diffRecord) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(records)
+}
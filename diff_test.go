@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/fireflycons/yaml-merge/pkg/yamlmerge"
+)
+
+func TestDiffDocuments(t *testing.T) {
+	names := []string{"base.yaml", "override.yaml"}
+
+	output := &strings.Builder{}
+	err := diffDocuments(names, true, yamlmerge.Merger{}, output,
+		strings.NewReader(`{"one": 1, "two": 2}`),
+		strings.NewReader(`{"one": 42, "three": 3}`),
+	)
+	require.NoError(t, err)
+
+	var records []diffRecord
+	require.NoError(t, json.Unmarshal([]byte(output.String()), &records))
+
+	byPath := make(map[string]diffRecord, len(records))
+	for _, r := range records {
+		byPath[r.Path] = r
+	}
+
+	one := byPath["one"]
+	require.Equal(t, "override.yaml", one.Winner.File)
+	require.Len(t, one.Overridden, 1)
+	require.Equal(t, "base.yaml", one.Overridden[0].File)
+	require.Equal(t, "1", one.Overridden[0].Value)
+
+	two := byPath["two"]
+	require.Equal(t, "base.yaml", two.Winner.File)
+	require.Empty(t, two.Overridden)
+
+	three := byPath["three"]
+	require.Equal(t, "override.yaml", three.Winner.File)
+}
+
+func TestDiffDocumentsTypeConflict(t *testing.T) {
+	names := []string{"base.yaml", "override.yaml"}
+	output := &strings.Builder{}
+	err := diffDocuments(names, false, yamlmerge.Merger{}, output,
+		strings.NewReader(`{"one": 1}`),
+		strings.NewReader(`{"one": {"nested": true}}`),
+	)
+	require.NoError(t, err)
+	require.Contains(t, output.String(), "one (type conflict)")
+}
+
+func TestDiffDocumentsCaseInsensitive(t *testing.T) {
+	names := []string{"base.yaml", "override.yaml"}
+	output := &strings.Builder{}
+	err := diffDocuments(names, true, yamlmerge.Merger{CaseInsensitive: true}, output,
+		strings.NewReader(`{"One": 1, "Two": 2}`),
+		strings.NewReader(`{"one": 42}`),
+	)
+	require.NoError(t, err)
+
+	var records []diffRecord
+	require.NoError(t, json.Unmarshal([]byte(output.String()), &records))
+
+	byPath := make(map[string]diffRecord, len(records))
+	for _, r := range records {
+		byPath[r.Path] = r
+	}
+
+	// The override only beats "One" because -ci folds its casing; it must
+	// not show up as an unrelated third path.
+	require.Len(t, records, 2)
+	one := byPath["one"]
+	require.Equal(t, "override.yaml", one.Winner.File)
+	require.Len(t, one.Overridden, 1)
+	require.Equal(t, "base.yaml", one.Overridden[0].File)
+
+	two := byPath["Two"]
+	require.Equal(t, "base.yaml", two.Winner.File)
+}
+
+func TestDiffDocumentsSeqAppendNothingOverridden(t *testing.T) {
+	names := []string{"base.yaml", "override.yaml"}
+	output := &strings.Builder{}
+	err := diffDocuments(names, false,
+		yamlmerge.Merger{SeqStrategy: yamlmerge.SeqStrategy{Mode: yamlmerge.SeqAppend}}, output,
+		strings.NewReader(`{"foo": [1, 2, 3]}`),
+		strings.NewReader(`{"foo": [4, 5, 6]}`),
+	)
+	require.NoError(t, err)
+
+	// Under -seq append, every item from every source survives into the
+	// merged sequence, so nothing should be reported as overridden.
+	require.NotContains(t, output.String(), "overridden:")
+}
+
+func TestDiffDocumentsRejectsDuplicateKeys(t *testing.T) {
+	names := []string{"base.yaml", "override.yaml"}
+	output := &strings.Builder{}
+	err := diffDocuments(names, false, yamlmerge.Merger{}, output,
+		strings.NewReader(`{"one": 1, "two": 2, "one": 99}`),
+		strings.NewReader(`{}`),
+	)
+	require.ErrorContains(t, err, "already defined")
+}
+
+func TestDiffDocumentsSeqReplaceDiscardsEarlierSources(t *testing.T) {
+	names := []string{"d1.yaml", "d2.yaml", "d3.yaml"}
+	output := &strings.Builder{}
+	err := diffDocuments(names, false, yamlmerge.Merger{}, output,
+		strings.NewReader(`{"foo": [1, 2]}`),
+		strings.NewReader(`{"foo": [3, 4]}`),
+		strings.NewReader("foo: !merge:append [5, 6]"),
+	)
+	require.NoError(t, err)
+
+	// d2 (default replace) discards d1 entirely before d3 appends on top,
+	// matching the real merge's [3,4,5,6]; d1 must show up as overridden,
+	// not be silently omitted.
+	text := output.String()
+	require.Contains(t, text, "overridden: d1.yaml:1 = [2 items]")
+	require.Contains(t, text, "foo[2]")
+	require.Contains(t, text, "winner: d3.yaml")
+}
+
+func TestDiffDocumentsSeqKeyedMergeRecursesAcrossSources(t *testing.T) {
+	names := []string{"k1.yaml", "k2.yaml", "k3.yaml"}
+	output := &strings.Builder{}
+	err := diffDocuments(names, true,
+		yamlmerge.Merger{SeqStrategy: yamlmerge.SeqStrategy{Mode: yamlmerge.SeqKeyedMerge, Key: "name"}}, output,
+		strings.NewReader(`{"foo": [{"name": "a", "value": 1}]}`),
+		strings.NewReader(`{"foo": [{"name": "a", "value": 2}]}`),
+		strings.NewReader(`{"foo": [{"name": "a", "value": 3}]}`),
+	)
+	require.NoError(t, err)
+
+	var records []diffRecord
+	require.NoError(t, json.Unmarshal([]byte(output.String()), &records))
+
+	byPath := make(map[string]diffRecord, len(records))
+	for _, r := range records {
+		byPath[r.Path] = r
+	}
+
+	// A merge-by match across all three sources must recurse to field
+	// level, not collapse into a single no-overrides record.
+	value := byPath["foo[0].value"]
+	require.Equal(t, "k3.yaml", value.Winner.File)
+	require.Len(t, value.Overridden, 2)
+}
+
+func TestDiffDocumentsMultiDocumentSource(t *testing.T) {
+	names := []string{"multi.yaml"}
+	output := &strings.Builder{}
+	err := diffDocuments(names, true, yamlmerge.Merger{}, output,
+		strings.NewReader("a: 1\n---\nb: 2\n"),
+	)
+	require.NoError(t, err)
+
+	var records []diffRecord
+	require.NoError(t, json.Unmarshal([]byte(output.String()), &records))
+	require.Len(t, records, 2)
+}
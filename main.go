@@ -19,181 +19,380 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
 // THE SOFTWARE.
 
+// Command yaml-merge is a thin CLI wrapper around pkg/yamlmerge: it parses
+// flags, gathers input readers (including -local overlays and -set
+// overrides), and hands everything off to the library for the actual
+// merge.
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	yaml "gopkg.in/yaml.v3"
-)
 
-type (
-	// YAML/JSON has three fundamental types. When unmarshaled into interface{},
-	// they're represented like this.
-	mapping  = map[string]interface{}
-	sequence = []interface{}
-	// The third type is scalar which is simply interface{}
-	// however can be detected by not being one of the other two.
+	"github.com/fireflycons/yaml-merge/pkg/yamlmerge"
 )
 
-// Interface that can represent JSON or YAML encoder.
-type encoder interface {
-	Encode(interface{}) error
+// localOverlayFlag implements flag.Value so that -local can be given bare
+// (meaning the default ".local" suffix) or with an explicit suffix, e.g.
+// -local=.env.
+type localOverlayFlag struct {
+	enabled bool
+	suffix  string
 }
 
-// mergeDocuments deep-merges any number of YAML/JSON sources, with later sources taking
-// priority over earlier ones.
-//
-// Maps are deep-merged. For example,
-//
-//	{"one": 1, "two": 2} + {"one": 42, "three": 3}
-//	== {"one": 42, "two": 2, "three": 3}
-//
-// Sequences are replaced. For example,
-//
-//	{"foo": [1, 2, 3]} + {"foo": [4, 5, 6]}
-//	== {"foo": [4, 5, 6]}
-//
-// In non-strict mode, attempting to merge
-// mismatched types (e.g., merging a sequence into a map) replaces the old
-// value with the new.
-//
-// Enabling strict mode returns errors in the above case.
-func mergeDocuments(strict, toJson bool, dest io.Writer, sources ...io.Reader) error {
-	var merged interface{}
-	var hasContent bool
-
-	for i, r := range sources {
-		// JSON is YAML so doesn't matter what the input is.
-		d := yaml.NewDecoder(r)
-
-		var contents interface{}
-		if err := d.Decode(&contents); err == io.EOF {
-			// Skip empty and comment-only sources, which we should handle
-			// differently from explicit nils.
-			continue
-		} else if err != nil {
-			return fmt.Errorf("couldn't decode source (input file #%d): %v", i, err)
-		}
-
-		hasContent = true
-		pair, err := merge(merged, contents, strict)
-		if err != nil {
-			return err // error is already descriptive enough
-		}
-		merged = pair
-	}
+func (f *localOverlayFlag) String() string {
+	return f.suffix
+}
 
-	if !hasContent {
-		// No sources had any content. To distinguish this from a source with just
-		// an explicit top-level null, return an empty buffer.
+func (f *localOverlayFlag) Set(s string) error {
+	switch s {
+	case "false":
+		f.enabled = false
 		return nil
+	case "true", "":
+		f.suffix = ".local"
+	default:
+		f.suffix = s
 	}
+	f.enabled = true
+	return nil
+}
 
-	var enc encoder
+// IsBoolFlag lets -local be given without a value, the way -v or -s can be.
+func (f *localOverlayFlag) IsBoolFlag() bool { return true }
 
-	if toJson {
-		enc = json.NewEncoder(dest)
-		enc.(*json.Encoder).SetIndent("", "    ")
-	} else {
-		enc = yaml.NewEncoder(dest)
-	}
+// resolveInputFiles opens every file named by fileArgs (each of which may
+// itself be a comma-separated list) in order and, when overlay.enabled,
+// inserts each base file's <file><suffix> sibling immediately after it if
+// one is present. A missing overlay is silently skipped; any other open
+// failure, for a base file or an overlay, is a hard error.
+func resolveInputFiles(fileArgs []string, overlay localOverlayFlag) ([]io.Reader, []string, error) {
+	var readers []io.Reader
+	var names []string
 
-	if err := enc.Encode(merged); err != nil {
-		return fmt.Errorf("couldn't re-serialize merged documents: %v", err)
+	for _, fileArg := range fileArgs {
+		// Allow commma separated list of files as single arg
+		for _, f := range strings.Split(fileArg, ",") {
+			rd, err := os.Open(f)
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot open %s for reading: %v", f, err)
+			}
+			readers = append(readers, rd)
+			names = append(names, f)
+
+			if !overlay.enabled {
+				continue
+			}
+
+			overlayFile := f + overlay.suffix
+			rd, err = os.Open(overlayFile)
+			if err == nil {
+				readers = append(readers, rd)
+				names = append(names, overlayFile)
+			} else if !os.IsNotExist(err) {
+				return nil, nil, fmt.Errorf("cannot open %s for reading: %v", overlayFile, err)
+			}
+		}
 	}
+
+	return readers, names, nil
+}
+
+// setAssignment is one -set/-set-string/-set-file flag, in the order it was
+// given on the command line.
+type setAssignment struct {
+	kind string // "value", "string", or "file"
+	spec string // "name=value"
+}
+
+// setAssignments accumulates -set/-set-string/-set-file flags in
+// command-line order, since later assignments to the same path must win.
+type setAssignments []setAssignment
+
+// setFlag adapts setAssignments to flag.Value for a single flag name, so
+// that -set, -set-string and -set-file can share one ordered slice.
+type setFlag struct {
+	assignments *setAssignments
+	kind        string
+}
+
+func (f *setFlag) String() string { return "" }
+
+func (f *setFlag) Set(s string) error {
+	*f.assignments = append(*f.assignments, setAssignment{kind: f.kind, spec: s})
 	return nil
 }
 
-// merge performs the merge of element 'from' into element 'into'.
-func merge(into, from interface{}, strict bool) (interface{}, error) {
-
-	switch {
-	case into == nil:
-		// No change
-		return from, nil
-	case from == nil:
-		// Allow higher-priority document to explicitly nil out lower-priority entries.
-		return nil, nil
-	case isScalar(into) && isScalar(from):
-		// Both elements are a scalar entry
-		return from, nil
-	case isSequence(into) && isSequence(from):
-		// Both elements are a sequence
-		return from, nil
-	case isMapping(into) && isMapping(from):
-		// Both elements are a map
-		return mergeMapping(into.(mapping), from.(mapping), strict)
-	case !strict:
-		// value types don't match, so no merge is possible. For backward
-		// compatibility, ignore mismatches unless we're in strict mode and return
-		// the higher-priority value.
-		return from, nil
-	default:
-		return nil, fmt.Errorf("can't merge a %s into a %s", describe(from), describe(into))
-	}
+// pathSegment is one element of a dotted override path: either a mapping
+// key, or a sequence index such as the `[0]` in `a.b[0].c`.
+type pathSegment struct {
+	key     string
+	index   int
+	isIndex bool
 }
 
-// mergeMapping recursively merges map `from` into map `into`.
-func mergeMapping(into, from mapping, strict bool) (mapping, error) {
-	// Output map will be at least the same number of keys as the `into` doc
-	merged := make(mapping, len(into))
+// parsePath parses a dotted override path into its segments. A dot
+// preceded by a backslash is treated as a literal character in a key
+// rather than a path separator.
+func parsePath(path string) ([]pathSegment, error) {
+	var segs []pathSegment
+	var cur strings.Builder
+
+	flush := func() {
+		if cur.Len() > 0 {
+			segs = append(segs, pathSegment{key: cur.String()})
+			cur.Reset()
+		}
+	}
 
-	// Copy `into` doc to output doc
-	for k, v := range into {
-		merged[k] = v
+	for i := 0; i < len(path); {
+		switch c := path[i]; c {
+		case '\\':
+			if i+1 >= len(path) {
+				return nil, fmt.Errorf("trailing escape character in path %q", path)
+			}
+			cur.WriteByte(path[i+1])
+			i += 2
+		case '.':
+			flush()
+			i++
+		case '[':
+			flush()
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated '[' in path %q", path)
+			}
+			idx, err := strconv.Atoi(path[i+1 : i+end])
+			if err != nil {
+				return nil, fmt.Errorf("invalid array index in path %q: %v", path, err)
+			}
+			if idx < 0 {
+				return nil, fmt.Errorf("negative array index in path %q", path)
+			}
+			segs = append(segs, pathSegment{index: idx, isIndex: true})
+			i += end + 1
+		default:
+			cur.WriteByte(c)
+			i++
+		}
 	}
+	flush()
 
-	// Enumerate keys of `from` doc, replacing
-	// matching keys of `into` with values from `from`
-	for k := range from {
-		// Recursively merge this value
-		m, err := merge(merged[k], from[k], strict)
+	if len(segs) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+	return segs, nil
+}
+
+// buildSetNode turns a sequence of -set/-set-string/-set-file assignments
+// into a single synthetic mapping tree, applied in order so that a later
+// assignment to the same path overrides an earlier one.
+func buildSetNode(assignments setAssignments) (*yaml.Node, error) {
+	var root *yaml.Node
 
+	for _, a := range assignments {
+		name, raw, ok := strings.Cut(a.spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid -set value %q: expected name=value", a.spec)
+		}
+
+		path, err := parsePath(name)
 		if err != nil {
 			return nil, err
 		}
 
-		merged[k] = m
+		value, err := buildSetValueNode(a.kind, raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %q: %v", name, err)
+		}
+
+		root, err = setPath(root, path, value)
+		if err != nil {
+			return nil, fmt.Errorf("can't set %q: %v", name, err)
+		}
 	}
 
-	return merged, nil
+	return root, nil
 }
 
-// isMapping reports whether a type is a mapping in YAML, represented as a
-// map[interface{}]interface{}.
-func isMapping(i interface{}) bool {
-	_, is := i.(mapping)
-	return is
+// buildSetValueNode builds the leaf node for one assignment: parsed as a
+// YAML scalar for -set, forced to a string for -set-string, or read
+// verbatim from disk for -set-file.
+func buildSetValueNode(kind, raw string) (*yaml.Node, error) {
+	switch kind {
+	case "string":
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: raw}, nil
+	case "file":
+		data, err := os.ReadFile(raw)
+		if err != nil {
+			return nil, err
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: string(data)}, nil
+	default:
+		var n yaml.Node
+		if err := yaml.Unmarshal([]byte(raw), &n); err != nil {
+			return nil, err
+		}
+		if len(n.Content) == 0 {
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+		}
+		return n.Content[0], nil
+	}
 }
 
-// isSequence reports whether a type is a sequence in YAML, represented as an
-// []interface{}.
-func isSequence(i interface{}) bool {
-	_, is := i.(sequence)
-	return is
+// isNullSetNode reports whether n is an explicit YAML null scalar, as
+// produced for an unset intermediate path segment.
+func isNullSetNode(n *yaml.Node) bool {
+	return n.Kind == yaml.ScalarNode && n.Tag == "!!null"
 }
 
-// isScalar reports whether a type is a scalar value in YAML.
-func isScalar(i interface{}) bool {
-	return !isMapping(i) && !isSequence(i)
+// findMapKey returns the index of key's value within mapping node m's
+// Content, or -1 if the key isn't present.
+func findMapKey(m *yaml.Node, key string) int {
+	for i := 0; i < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
 }
 
-// describe describes the element type of i.
-func describe(i interface{}) string {
-	if isMapping(i) {
-		return "mapping"
+// newContainerFor returns an empty mapping or sequence node, matching the
+// kind of path segment that will be stored inside it.
+func newContainerFor(seg pathSegment) *yaml.Node {
+	if seg.isIndex {
+		return &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
 	}
-	if isSequence(i) {
-		return "sequence"
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+}
+
+// setPath writes value at path within root, creating intermediate mappings
+// and sequences as needed, and returns the (possibly new) root node.
+func setPath(root *yaml.Node, path []pathSegment, value *yaml.Node) (*yaml.Node, error) {
+	if root == nil {
+		root = newContainerFor(path[0])
 	}
-	return "scalar"
+
+	cur := root
+	for i, seg := range path {
+		last := i == len(path)-1
+
+		if seg.isIndex {
+			if cur.Kind != yaml.SequenceNode {
+				return nil, fmt.Errorf("index [%d] used on a non-sequence value", seg.index)
+			}
+			for len(cur.Content) <= seg.index {
+				cur.Content = append(cur.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"})
+			}
+			if last {
+				cur.Content[seg.index] = value
+				return root, nil
+			}
+			if next := cur.Content[seg.index]; !isNullSetNode(next) {
+				cur = next
+			} else {
+				next := newContainerFor(path[i+1])
+				cur.Content[seg.index] = next
+				cur = next
+			}
+			continue
+		}
+
+		if cur.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("key %q used on a non-mapping value", seg.key)
+		}
+		idx := findMapKey(cur, seg.key)
+		if last {
+			if idx < 0 {
+				cur.Content = append(cur.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: seg.key}, value)
+			} else {
+				cur.Content[idx+1] = value
+			}
+			return root, nil
+		}
+		if idx < 0 {
+			next := newContainerFor(path[i+1])
+			cur.Content = append(cur.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: seg.key}, next)
+			cur = next
+		} else if next := cur.Content[idx+1]; !isNullSetNode(next) {
+			cur = next
+		} else {
+			next := newContainerFor(path[i+1])
+			cur.Content[idx+1] = next
+			cur = next
+		}
+	}
+
+	return root, nil
+}
+
+// writeMergedNodes writes the result of a merge to dest: a single document
+// for DocModeMerge/DocModeFirst, or a `---`-separated stream (or JSON
+// array, if toJson) of one document per paired index for DocModeStream.
+func writeMergedNodes(nodes []*yaml.Node, doc yamlmerge.DocMode, toJson bool, dest io.Writer) error {
+	if len(nodes) == 0 {
+		// No sources had any content. To distinguish this from a source with
+		// just an explicit top-level null, write nothing at all.
+		return nil
+	}
+
+	if doc != yamlmerge.DocModeStream {
+		return encodeDocument(nodes[0], toJson, dest)
+	}
+
+	if toJson {
+		values := make([]interface{}, len(nodes))
+		for i, n := range nodes {
+			if err := n.Decode(&values[i]); err != nil {
+				return fmt.Errorf("couldn't re-serialize merged documents: %v", err)
+			}
+		}
+		enc := json.NewEncoder(dest)
+		enc.SetIndent("", "    ")
+		if err := enc.Encode(values); err != nil {
+			return fmt.Errorf("couldn't re-serialize merged documents: %v", err)
+		}
+		return nil
+	}
+
+	enc := yaml.NewEncoder(dest)
+	for _, n := range nodes {
+		if err := enc.Encode(n); err != nil {
+			return fmt.Errorf("couldn't re-serialize merged documents: %v", err)
+		}
+	}
+	return enc.Close()
+}
+
+// encodeDocument writes a single merged document to dest as YAML, or as
+// JSON when toJson is set.
+func encodeDocument(n *yaml.Node, toJson bool, dest io.Writer) error {
+	if toJson {
+		var v interface{}
+		if err := n.Decode(&v); err != nil {
+			return fmt.Errorf("couldn't re-serialize merged documents: %v", err)
+		}
+		enc := json.NewEncoder(dest)
+		enc.SetIndent("", "    ")
+		if err := enc.Encode(v); err != nil {
+			return fmt.Errorf("couldn't re-serialize merged documents: %v", err)
+		}
+		return nil
+	}
+
+	if err := yaml.NewEncoder(dest).Encode(n); err != nil {
+		return fmt.Errorf("couldn't re-serialize merged documents: %v", err)
+	}
+	return nil
 }
 
 func usage() {
@@ -203,8 +402,10 @@ func usage() {
 }
 
 func main() {
-	var strict, toJson, verbose bool
-	var outputFilename string
+	var strict, toJson, verbose, ci, diffFlag bool
+	var outputFilename, seqFlag, docModeFlag, diffFormatFlag string
+	var localOverlay localOverlayFlag
+	var sets setAssignments
 
 	output := os.Stdout
 
@@ -212,35 +413,65 @@ func main() {
 	flag.StringVar(&outputFilename, "o", "", "Output file (stdout if not present)")
 	flag.BoolVar(&toJson, "j", false, "Output JSON instead of YAML. Auto-enabled if output file has .json extension")
 	flag.BoolVar(&verbose, "v", false, "Verbose (messages written to stderr)")
+	flag.BoolVar(&ci, "ci", false, "Treat mapping keys as case-insensitive when merging")
+	flag.StringVar(&seqFlag, "seq", "replace", "Sequence merge strategy: replace, append, prepend, unique, or merge-by:<key>")
+	flag.Var(&localOverlay, "local", "Overlay <file><suffix> onto each input file if present (suffix defaults to .local)")
+	flag.StringVar(&docModeFlag, "doc-mode", "merge", "How to handle multi-document YAML streams: merge, first, or stream")
+	flag.Var(&setFlag{&sets, "value"}, "set", "Set a value at a dotted path, e.g. -set a.b[0].c=42 (repeatable)")
+	flag.Var(&setFlag{&sets, "string"}, "set-string", "Like -set, but always stores the value as a string (repeatable)")
+	flag.Var(&setFlag{&sets, "file"}, "set-file", "Like -set, but reads the value verbatim from the named file (repeatable)")
+	flag.BoolVar(&diffFlag, "diff", false, "Print a structured diff of which source contributed each value instead of merging")
+	flag.StringVar(&diffFormatFlag, "diff-format", "text", "Format for -diff output: text or json")
 	flag.Usage = usage
 	flag.Parse()
 
-	readers := make([]io.Reader, 0, len(flag.Args()))
+	seq, err := yamlmerge.ParseSeqStrategy(seqFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -seq value: %v\n", err)
+		os.Exit(1)
+	}
+
+	doc, err := yamlmerge.ParseDocMode(docModeFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -doc-mode value: %v\n", err)
+		os.Exit(1)
+	}
+
+	readers, names, err := resolveInputFiles(flag.Args(), localOverlay)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	for _, rd := range readers {
+		defer rd.(*os.File).Close()
+	}
 
 	if verbose {
 		fmt.Fprintf(os.Stderr, "Files to be merged in this order:\n\n")
+		for i, n := range names {
+			fmt.Fprintf(os.Stderr, "  %02d. %s\n", i+1, n)
+		}
 	}
 
-	// Remaining non-flag arguments are files to merge.
-	count := 0
-	for _, fileArg := range flag.Args() {
-		// Allow commma separated list of files as single arg
-		for _, f := range strings.Split(fileArg, ",") {
-			if rd, err := os.Open(f); err == nil {
-				readers = append(readers, rd)
-				defer func(i int) {
-					readers[i].(*os.File).Close()
-				}(count)
+	if len(sets) > 0 {
+		node, err := buildSetNode(sets)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -set/-set-string/-set-file value: %v\n", err)
+			os.Exit(1)
+		}
 
-				count++
-				if verbose {
-					fmt.Fprintf(os.Stderr, "  %02d. %s\n", count, f)
-				}
+		data, err := yaml.Marshal(node)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "couldn't encode -set overrides: %v\n", err)
+			os.Exit(1)
+		}
 
-			} else {
-				fmt.Fprintf(os.Stderr, "cannot open %s for reading: %v\n", f, err)
-				os.Exit(1)
-			}
+		// Appended last so it merges on top of every file source, per the
+		// usual last-source-wins precedence.
+		readers = append(readers, bytes.NewReader(data))
+		names = append(names, "(--set overrides)")
+		if verbose {
+			fmt.Fprintf(os.Stderr, "  %02d. (--set overrides)\n", len(names))
 		}
 	}
 
@@ -264,10 +495,36 @@ func main() {
 		defer output.Close()
 	}
 
-	err := mergeDocuments(strict, toJson, output, readers...)
+	if diffFlag {
+		diffJSON, err := parseDiffFormat(diffFormatFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -diff-format value: %v\n", err)
+			os.Exit(1)
+		}
+
+		diffMerger := yamlmerge.Merger{Strict: strict, SeqStrategy: seq, CaseInsensitive: ci, DocMode: doc}
+		if err := diffDocuments(names, diffJSON, diffMerger, output, readers...); err != nil {
+			fmt.Fprintf(os.Stderr, "diff error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	merger := yamlmerge.Merger{
+		Strict:          strict,
+		SeqStrategy:     seq,
+		CaseInsensitive: ci,
+		DocMode:         doc,
+	}
 
+	nodes, err := merger.MergeReaderNodes(readers...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "merge error: %v\n", err)
 		os.Exit(1)
 	}
+
+	if err := writeMergedNodes(nodes, doc, toJson, output); err != nil {
+		fmt.Fprintf(os.Stderr, "merge error: %v\n", err)
+		os.Exit(1)
+	}
 }
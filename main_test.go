@@ -1,168 +1,119 @@
 package main
 
 import (
-	"io"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 	yaml "gopkg.in/yaml.v3"
+
+	"github.com/fireflycons/yaml-merge/pkg/yamlmerge"
 )
 
-func unmarshal(yml string) interface{} {
-	var contents interface{}
-	var nilResult map[string]interface{}
-	d := yaml.NewDecoder(strings.NewReader(yml))
-	if err := d.Decode(&contents); err == io.EOF {
-		return nilResult
-	} else if err != nil {
-		panic(err)
+func TestBuildSetNode(t *testing.T) {
+	assignments := setAssignments{
+		{kind: "value", spec: "a.b[0].c=42"},
+		{kind: "value", spec: "a.b[1]=true"},
+		{kind: "string", spec: "a.n=42"},
+		{kind: "value", spec: `escaped\.dot=1`},
 	}
 
-	return contents
-}
+	node, err := buildSetNode(assignments)
+	require.NoError(t, err)
 
-func TestMerge(t *testing.T) {
-
-	testcases := []struct {
-		name          string
-		input1        string
-		input2        string
-		expectError   bool
-		errorContains string
-		toJson        bool
-		strict        bool
-		output        map[string]interface{}
-	}{
-		{
-			name:        "merge simple maps",
-			input1:      `{"one": 1, "two": 2}`,
-			input2:      `{"one": 42, "three": 3}`,
-			expectError: false,
-			output: map[string]interface{}{
-				"one":   42,
-				"two":   2,
-				"three": 3,
-			},
-		},
-		{
-			name:        "merge simple maps output JSON",
-			input1:      `{"one": 1, "two": 2}`,
-			input2:      `{"one": 42, "three": 3}`,
-			expectError: false,
-			toJson:      true,
-			output: map[string]interface{}{
-				"one":   42,
-				"two":   2,
-				"three": 3,
-			},
-		},
-		{
-			name:        "merge simple sequences",
-			input1:      `{"foo": [1, 2, 3]}}`,
-			input2:      `{"foo": [4, 5, 6]}`,
-			expectError: false,
-			output: map[string]interface{}{
-				"foo": []interface{}{
-					4, 5, 6,
-				},
-			},
-		},
-		{
-			name: "test n",
-			// Assert that this value is treated as string and not boolean false
-			input1:      `marker: n`,
-			input2:      ``,
-			expectError: false,
-			output: map[string]interface{}{
-				"marker": "n",
-			},
-		},
-		{
-			name:          "duplicate key",
-			input1:        `{"one": 1, "two": 2, "one": 99}`,
-			input2:        `{"one": 42, "three": 3}`,
-			expectError:   true,
-			errorContains: "already defined",
-		},
-		{
-			name:        "non-strict",
-			input1:      `{"one": 1, "two": 2}`,
-			input2:      `{"one": [1, 2], "three": 3}`,
-			expectError: false,
-			output: map[string]interface{}{
-				"one": []interface{}{
-					1,
-					2,
-				},
-				"two":   2,
-				"three": 3,
-			},
-		},
-		{
-			name:          "strict",
-			input1:        `{"one": 1, "two": 2}`,
-			input2:        `{"one": [1, 2], "three": 3}`,
-			strict:        true,
-			expectError:   true,
-			errorContains: "can't merge a sequence into a scalar",
-		},
-		{
-			name:          "input-error",
-			input1:        `{"one": 1, "two": 2`,
-			input2:        `{"one": [1, 2], "three": 3}`,
-			expectError:   true,
-			errorContains: "couldn't decode source",
-		},
-		{
-			name:   "empty inputs",
-			input1: ``,
-			input2: ``,
-			output: nil,
-		},
-		{
-			name:   "first input empty",
-			input1: ``,
-			input2: `{"one": 1, "two": 2}`,
-			output: map[string]interface{}{
-				"one": 1,
-				"two": 2,
-			},
-		},
-		{
-			name:   "second input empty",
-			input1: `{"one": 1, "two": 2}`,
-			input2: ``,
-			output: map[string]interface{}{
-				"one": 1,
-				"two": 2,
-			},
-		},
-		{
-			name:        "null value",
-			input1:      `{"one": 1, "two": 2}`,
-			input2:      `{"one": 42, "two": null}`,
-			expectError: false,
-			output: map[string]interface{}{
-				"one": 42,
-				"two": nil,
+	data, err := yaml.Marshal(node)
+	require.NoError(t, err)
+
+	var got interface{}
+	require.NoError(t, yaml.Unmarshal(data, &got))
+
+	require.Equal(t, map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": []interface{}{
+				map[string]interface{}{"c": 42},
+				true,
 			},
+			"n": "42",
 		},
+		"escaped.dot": 1,
+	}, got)
+}
+
+func TestBuildSetNodeNegativeIndex(t *testing.T) {
+	_, err := buildSetNode(setAssignments{{kind: "value", spec: "a[-1]=1"}})
+	require.ErrorContains(t, err, "negative array index")
+}
+
+func TestResolveInputFilesLocalOverlay(t *testing.T) {
+	dir := t.TempDir()
+
+	base := filepath.Join(dir, "base.yaml")
+	require.NoError(t, os.WriteFile(base, []byte("one: 1\n"), 0644))
+	overlay := base + ".local"
+	require.NoError(t, os.WriteFile(overlay, []byte("one: 2\n"), 0644))
+
+	noOverlay := filepath.Join(dir, "no-overlay.yaml")
+	require.NoError(t, os.WriteFile(noOverlay, []byte("two: 2\n"), 0644))
+
+	readers, names, err := resolveInputFiles([]string{base, noOverlay}, localOverlayFlag{enabled: true, suffix: ".local"})
+	require.NoError(t, err)
+	for _, rd := range readers {
+		defer rd.(*os.File).Close()
 	}
 
-	for _, tc := range testcases {
-		t.Run(tc.name, func(t *testing.T) {
-			output := &strings.Builder{}
-			err := mergeDocuments(tc.strict, tc.toJson, output, strings.NewReader(tc.input1), strings.NewReader(tc.input2))
-			if tc.expectError {
-				require.ErrorContains(t, err, tc.errorContains)
-			} else {
-				require.NoError(t, err)
-				if tc.toJson {
-					require.True(t, output.String()[0] == '{' || output.String()[0] == '[')
-				}
-				require.Equal(t, tc.output, unmarshal(output.String()))
-			}
-		})
+	// The overlay is inserted immediately after its base file; a base file
+	// with no sibling overlay contributes just itself.
+	require.Equal(t, []string{base, overlay, noOverlay}, names)
+}
+
+func TestResolveInputFilesLocalOverlayUnreadable(t *testing.T) {
+	dir := t.TempDir()
+
+	base := filepath.Join(dir, "base.yaml")
+	require.NoError(t, os.WriteFile(base, []byte("one: 1\n"), 0644))
+
+	// base.yaml is a regular file, so "<base>/x" can never be opened
+	// (ENOTDIR, since base.yaml isn't a directory) regardless of the
+	// test's user permissions: a reliable way to exercise the hard-error
+	// path distinct from a merely missing overlay.
+	_, _, err := resolveInputFiles([]string{base}, localOverlayFlag{enabled: true, suffix: "/x"})
+	require.ErrorContains(t, err, "cannot open")
+}
+
+func TestResolveInputFilesNoOverlayFlag(t *testing.T) {
+	dir := t.TempDir()
+
+	base := filepath.Join(dir, "base.yaml")
+	require.NoError(t, os.WriteFile(base, []byte("one: 1\n"), 0644))
+	require.NoError(t, os.WriteFile(base+".local", []byte("one: 2\n"), 0644))
+
+	readers, names, err := resolveInputFiles([]string{base}, localOverlayFlag{})
+	require.NoError(t, err)
+	for _, rd := range readers {
+		defer rd.(*os.File).Close()
 	}
+
+	// Without -local, a sibling .local file is never picked up.
+	require.Equal(t, []string{base}, names)
+}
+
+func TestBuildSetNodeMergesAsHighestPriority(t *testing.T) {
+	node, err := buildSetNode(setAssignments{{kind: "value", spec: "one=99"}})
+	require.NoError(t, err)
+
+	data, err := yaml.Marshal(node)
+	require.NoError(t, err)
+
+	var merger yamlmerge.Merger
+	got, err := merger.MergeReaders(
+		strings.NewReader(`{"one": 1, "two": 2}`),
+		strings.NewReader(string(data)),
+	)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{
+		"one": 99,
+		"two": 2,
+	}, got)
 }
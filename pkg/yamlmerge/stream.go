@@ -0,0 +1,232 @@
+// Copyright (c) 2024 Firefly Consulting Ltd.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package yamlmerge
+
+import (
+	"fmt"
+	"io"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// DocMode selects how a source's YAML document stream (documents separated
+// by `---`) is treated.
+type DocMode int
+
+const (
+	// DocModeMerge folds every document from every source, in order, into
+	// a single result. This is the default.
+	DocModeMerge DocMode = iota
+	// DocModeFirst only looks at the first document of each source,
+	// ignoring the rest of the stream. This is the legacy behavior.
+	DocModeFirst
+	// DocModeStream pairs documents by index across sources and returns
+	// one merged result per index.
+	DocModeStream
+)
+
+// ParseDocMode parses the value of the CLI's -doc-mode flag.
+func ParseDocMode(s string) (DocMode, error) {
+	switch s {
+	case "", "merge":
+		return DocModeMerge, nil
+	case "first":
+		return DocModeFirst, nil
+	case "stream":
+		return DocModeStream, nil
+	default:
+		return 0, fmt.Errorf("unknown doc mode %q", s)
+	}
+}
+
+// decodeDocumentStream decodes every document in r's `---`-separated YAML
+// stream, returning the root content node of each.
+func decodeDocumentStream(r io.Reader) ([]*yaml.Node, error) {
+	d := yaml.NewDecoder(r)
+
+	var docs []*yaml.Node
+	for {
+		var doc yaml.Node
+		if err := d.Decode(&doc); err == io.EOF {
+			// Skip empty and comment-only sources, which we should handle
+			// differently from explicit nils.
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc.Content[0])
+	}
+	return docs, nil
+}
+
+// decodeSources decodes every source's document stream and checks each
+// document for duplicate keys, honoring m.DocMode's first-document-only
+// behavior.
+func (m Merger) decodeSources(sources []io.Reader) ([][]*yaml.Node, error) {
+	perSource := make([][]*yaml.Node, len(sources))
+
+	for i, r := range sources {
+		docs, err := decodeDocumentStream(r)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode source (input file #%d): %v", i, err)
+		}
+
+		if m.DocMode == DocModeFirst && len(docs) > 1 {
+			docs = docs[:1]
+		}
+
+		for _, content := range docs {
+			if err := m.CheckDuplicateKeys(content); err != nil {
+				return nil, fmt.Errorf("couldn't decode source (input file #%d): %v", i, err)
+			}
+		}
+
+		perSource[i] = docs
+	}
+
+	return perSource, nil
+}
+
+// DecodeSources decodes every source's `---`-separated YAML document
+// stream and checks each document for duplicate keys, honoring
+// m.DocMode's first-document-only truncation, without merging them.
+// Callers that need to predict a merge's outcome without performing it
+// (such as the CLI's -diff mode) can use this to stay consistent with
+// Merger's own decoding and validation of sources.
+func (m Merger) DecodeSources(sources []io.Reader) ([][]*yaml.Node, error) {
+	return m.decodeSources(sources)
+}
+
+// MergeReaderNodes decodes every source's `---`-separated YAML document
+// stream and merges them according to m.DocMode, returning the merged
+// result as node trees: a single element for DocModeMerge and
+// DocModeFirst, or one element per paired document index for
+// DocModeStream. It returns a nil slice if no source had any content.
+func (m Merger) MergeReaderNodes(sources ...io.Reader) ([]*yaml.Node, error) {
+	perSource, err := m.decodeSources(sources)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.DocMode == DocModeStream {
+		return m.mergeDocumentStreamNodes(perSource)
+	}
+
+	var merged *yaml.Node
+	var hasContent bool
+
+	for _, docs := range perSource {
+		for _, content := range docs {
+			hasContent = true
+			n, err := m.mergeNode(merged, content)
+			if err != nil {
+				return nil, err
+			}
+			merged = n
+		}
+	}
+
+	if !hasContent {
+		// No sources had any content. To distinguish this from a source
+		// with just an explicit top-level null, return no documents.
+		return nil, nil
+	}
+
+	return []*yaml.Node{merged}, nil
+}
+
+// mergeDocumentStreamNodes merges documents pairwise by index across
+// sources (source A's 2nd document merges with source B's 2nd document,
+// etc.), returning one merged node per index. A source with fewer
+// documents than the longest stream has its last document broadcast
+// across the remaining indices, so a single-document source still
+// overlays every paired document rather than only the first.
+func (m Merger) mergeDocumentStreamNodes(perSource [][]*yaml.Node) ([]*yaml.Node, error) {
+	docCount := 0
+	for _, docs := range perSource {
+		if len(docs) > docCount {
+			docCount = len(docs)
+		}
+	}
+
+	results := make([]*yaml.Node, 0, docCount)
+	for i := 0; i < docCount; i++ {
+		var merged *yaml.Node
+		for _, docs := range perSource {
+			if len(docs) == 0 {
+				continue
+			}
+			// A source with fewer documents than the longest stream has its
+			// last document broadcast across the remaining paired indices,
+			// rather than contributing nothing to them.
+			idx := i
+			if idx >= len(docs) {
+				idx = len(docs) - 1
+			}
+			n, err := m.mergeNode(merged, docs[idx])
+			if err != nil {
+				return nil, err
+			}
+			merged = n
+		}
+		if merged != nil {
+			results = append(results, merged)
+		}
+	}
+
+	return results, nil
+}
+
+// MergeReaders decodes and deep-merges any number of YAML/JSON sources,
+// with later sources taking priority over earlier ones, and returns the
+// result decoded into interface{}. Each source may itself be a
+// `---`-separated stream of documents; how that stream is handled is
+// controlled by m.DocMode.
+//
+// Under DocModeStream, the result is a []interface{} with one element per
+// paired document index. Under DocModeMerge and DocModeFirst, the result
+// is the single merged document, or nil if no source had any content.
+func (m Merger) MergeReaders(sources ...io.Reader) (interface{}, error) {
+	nodes, err := m.MergeReaderNodes(sources...)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.DocMode == DocModeStream {
+		values := make([]interface{}, len(nodes))
+		for i, n := range nodes {
+			if err := n.Decode(&values[i]); err != nil {
+				return nil, fmt.Errorf("couldn't decode merged document: %v", err)
+			}
+		}
+		return values, nil
+	}
+
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+
+	var out interface{}
+	if err := nodes[0].Decode(&out); err != nil {
+		return nil, fmt.Errorf("couldn't decode merged document: %v", err)
+	}
+	return out, nil
+}
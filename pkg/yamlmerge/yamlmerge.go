@@ -0,0 +1,517 @@
+// Copyright (c) 2024 Firefly Consulting Ltd.
+// Portions Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package yamlmerge deep-merges YAML/JSON documents, with later sources
+// taking priority over earlier ones. It's the engine behind the yaml-merge
+// CLI, and can also be used directly as a library.
+package yamlmerge
+
+import (
+	"fmt"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// SeqMode selects the algorithm used to merge two sequences that occur at
+// the same path in two documents.
+type SeqMode int
+
+const (
+	// SeqReplace discards the lower-priority sequence entirely. This is the
+	// historical behavior and remains the default.
+	SeqReplace SeqMode = iota
+	// SeqAppend concatenates the higher-priority sequence onto the end of
+	// the lower-priority one.
+	SeqAppend
+	// SeqPrepend concatenates the lower-priority sequence onto the end of
+	// the higher-priority one.
+	SeqPrepend
+	// SeqUnique behaves like SeqAppend but drops items that are deep-equal
+	// to one already present.
+	SeqUnique
+	// SeqKeyedMerge treats both sequences as collections of mappings keyed
+	// by a field, deep-merging entries whose key matches and appending
+	// entries that don't.
+	SeqKeyedMerge
+)
+
+// SeqStrategy is a fully resolved sequence merge strategy, including the
+// key field used by SeqKeyedMerge.
+type SeqStrategy struct {
+	Mode SeqMode
+	Key  string
+}
+
+// ParseSeqStrategy parses a strategy string such as "append" or
+// "merge-by:name" into a SeqStrategy. It's used for the CLI's -seq flag
+// value, and for the per-node `!merge:<strategy>` tag and
+// `merge:<strategy>` comment overrides.
+func ParseSeqStrategy(s string) (SeqStrategy, error) {
+	if key, ok := strings.CutPrefix(s, "merge-by:"); ok {
+		if key == "" {
+			return SeqStrategy{}, fmt.Errorf("merge-by strategy requires a key, e.g. merge-by:name")
+		}
+		return SeqStrategy{Mode: SeqKeyedMerge, Key: key}, nil
+	}
+
+	switch s {
+	case "", "replace":
+		return SeqStrategy{Mode: SeqReplace}, nil
+	case "append":
+		return SeqStrategy{Mode: SeqAppend}, nil
+	case "prepend":
+		return SeqStrategy{Mode: SeqPrepend}, nil
+	case "unique":
+		return SeqStrategy{Mode: SeqUnique}, nil
+	default:
+		return SeqStrategy{}, fmt.Errorf("unknown sequence merge strategy %q", s)
+	}
+}
+
+// mergeTagPrefix is the YAML tag prefix recognised as a per-node sequence
+// strategy override, e.g. `!merge:append [1, 2, 3]`.
+const mergeTagPrefix = "!merge:"
+
+// directivePrefix is the comment prefix recognised as a per-node sequence
+// strategy override, e.g. `foo: [1, 2, 3] # merge:append`.
+const directivePrefix = "merge:"
+
+// nodeSeqStrategy resolves the sequence merge strategy to use for a
+// sequence node: an explicit `!merge:<strategy>` tag or `merge:<strategy>`
+// comment on the node takes priority over the document-wide default.
+func nodeSeqStrategy(n *yaml.Node, def SeqStrategy) (SeqStrategy, error) {
+	if s, ok := strings.CutPrefix(n.Tag, mergeTagPrefix); ok {
+		return ParseSeqStrategy(s)
+	}
+	if s, ok := directiveFromComment(n.LineComment); ok {
+		return ParseSeqStrategy(s)
+	}
+	if s, ok := directiveFromComment(n.HeadComment); ok {
+		return ParseSeqStrategy(s)
+	}
+	return def, nil
+}
+
+// NodeSeqStrategy resolves the sequence merge strategy that applies to
+// sequence node n: an explicit `!merge:<strategy>` tag or
+// `merge:<strategy>` comment on n overrides def. Callers that need to
+// predict a merge's outcome without performing it (such as the CLI's
+// -diff mode) can use this to stay consistent with Merger's own
+// resolution of per-node overrides.
+func NodeSeqStrategy(n *yaml.Node, def SeqStrategy) (SeqStrategy, error) {
+	return nodeSeqStrategy(n, def)
+}
+
+// NodesEqual reports whether a and b represent the same YAML value, the
+// same comparison SeqUnique uses to detect duplicates. Callers that need
+// to predict a merge's outcome without performing it (such as the CLI's
+// -diff mode) can use this to stay consistent with Merger's own dedup.
+func NodesEqual(a, b *yaml.Node) bool {
+	return nodesEqual(a, b)
+}
+
+// MappingKeyValue returns the string value of key within mapping node n,
+// honoring ci the same way SeqKeyedMerge's key matching does, and reports
+// whether n is a mapping with that key present. Callers that need to
+// predict a merge's outcome without performing it (such as the CLI's
+// -diff mode) can use this to stay consistent with Merger's own
+// SeqKeyedMerge matching.
+func MappingKeyValue(n *yaml.Node, key string, ci bool) (string, bool) {
+	if n.Kind != yaml.MappingNode {
+		return "", false
+	}
+	idx := findKey(n, key, ci)
+	if idx < 0 {
+		return "", false
+	}
+	return n.Content[idx+1].Value, true
+}
+
+// directiveFromComment extracts a `merge:<strategy>` directive from a YAML
+// comment, if present.
+func directiveFromComment(comment string) (string, bool) {
+	comment = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(comment), "#"))
+	s, ok := strings.CutPrefix(comment, directivePrefix)
+	return strings.TrimSpace(s), ok
+}
+
+// Merger deep-merges YAML/JSON documents according to its configured
+// options. The zero value is ready to use: sequences are replaced
+// wholesale, type mismatches between sources are tolerated, keys are
+// compared case-sensitively, and every document of a multi-document
+// source is merged in (DocModeMerge).
+type Merger struct {
+	// Strict causes mismatched value types at the same path (e.g. merging
+	// a sequence into a map) to be reported as an error instead of the
+	// higher-priority value silently winning. It also turns mapping keys
+	// that differ only in case, when CaseInsensitive is set, into an error;
+	// that check is made on sources decoded by MergeReaders,
+	// MergeReaderNodes and DecodeSources, not by Merge or MergeNodes.
+	Strict bool
+	// SeqStrategy is the default strategy used to merge two sequences at
+	// the same path. Individual sequences can opt out of this default with
+	// a `!merge:<strategy>` tag or a `merge:<strategy>` comment.
+	SeqStrategy SeqStrategy
+	// CaseInsensitive treats mapping keys as case-insensitive when
+	// deciding whether a key in a higher-priority source overrides one in
+	// a lower-priority source. The resulting key keeps the higher-priority
+	// source's casing.
+	CaseInsensitive bool
+	// DocMode controls how a source's `---`-separated YAML document
+	// stream is handled by MergeReaders and MergeReaderNodes.
+	DocMode DocMode
+}
+
+// Merge deep-merges src into dst, both already decoded into interface{}
+// (as produced by yaml.Unmarshal or encoding/json), and returns the
+// result.
+//
+// Maps are deep-merged. For example,
+//
+//	{"one": 1, "two": 2} + {"one": 42, "three": 3}
+//	== {"one": 42, "two": 2, "three": 3}
+//
+// Sequences are merged according to m.SeqStrategy, which defaults to
+// SeqReplace:
+//
+//	{"foo": [1, 2, 3]} + {"foo": [4, 5, 6]}
+//	== {"foo": [4, 5, 6]}
+//
+// In non-strict mode, attempting to merge mismatched types (e.g. merging a
+// sequence into a map) replaces the old value with the new; enabling
+// m.Strict returns an error in that case instead.
+func (m Merger) Merge(dst, src interface{}) (interface{}, error) {
+	var dstNode *yaml.Node
+	if dst != nil {
+		n, err := valueToNode(dst)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't encode destination value: %v", err)
+		}
+		dstNode = n
+	}
+
+	srcNode, err := valueToNode(src)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encode source value: %v", err)
+	}
+
+	merged, err := m.mergeNode(dstNode, srcNode)
+	if err != nil {
+		return nil, err
+	}
+
+	var out interface{}
+	if err := merged.Decode(&out); err != nil {
+		return nil, fmt.Errorf("couldn't decode merged value: %v", err)
+	}
+	return out, nil
+}
+
+// MergeNodes deep-merges already-decoded *yaml.Node document trees, in
+// order, with later nodes taking priority, and returns the merged node
+// tree. Unlike Merge and MergeReaders, this preserves YAML-specific detail
+// such as comments and tags on the nodes that survive the merge. A node of
+// Kind DocumentNode is automatically unwrapped to its content.
+func (m Merger) MergeNodes(nodes ...*yaml.Node) (*yaml.Node, error) {
+	var merged *yaml.Node
+
+	for _, n := range nodes {
+		content := n
+		if content != nil && content.Kind == yaml.DocumentNode {
+			content = content.Content[0]
+		}
+
+		result, err := m.mergeNode(merged, content)
+		if err != nil {
+			return nil, err
+		}
+		merged = result
+	}
+
+	return merged, nil
+}
+
+// valueToNode round-trips v through YAML encoding so that it can be merged
+// at the node level, the same way the CLI's -set flag builds synthetic
+// nodes out of scalar values.
+func valueToNode(v interface{}) (*yaml.Node, error) {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+	}
+	return doc.Content[0], nil
+}
+
+// mergeNode performs the merge of element 'from' into element 'into'.
+func (m Merger) mergeNode(into, from *yaml.Node) (*yaml.Node, error) {
+	switch {
+	case into == nil:
+		// No change
+		return from, nil
+	case isNullNode(from):
+		// Allow higher-priority document to explicitly nil out lower-priority entries.
+		return from, nil
+	case into.Kind == yaml.ScalarNode && from.Kind == yaml.ScalarNode:
+		// Both elements are a scalar entry
+		return from, nil
+	case into.Kind == yaml.SequenceNode && from.Kind == yaml.SequenceNode:
+		// Both elements are a sequence
+		strategy, err := nodeSeqStrategy(from, m.SeqStrategy)
+		if err != nil {
+			return nil, err
+		}
+		return m.mergeSequenceNode(into, from, strategy)
+	case into.Kind == yaml.MappingNode && from.Kind == yaml.MappingNode:
+		// Both elements are a map
+		return m.mergeMappingNode(into, from)
+	case !m.Strict:
+		// value types don't match, so no merge is possible. For backward
+		// compatibility, ignore mismatches unless we're in strict mode and
+		// return the higher-priority value.
+		return from, nil
+	default:
+		return nil, fmt.Errorf("can't merge a %s into a %s", describeNode(from), describeNode(into))
+	}
+}
+
+// mergeMappingNode recursively merges mapping node `from` into mapping node
+// `into`. When m.CaseInsensitive is set, keys are compared
+// case-insensitively and the winning key keeps the casing used by `from`.
+func (m Merger) mergeMappingNode(into, from *yaml.Node) (*yaml.Node, error) {
+	merged := cloneNode(into)
+
+	for i := 0; i < len(from.Content); i += 2 {
+		key, val := from.Content[i], from.Content[i+1]
+
+		idx := findKey(merged, key.Value, m.CaseInsensitive)
+		if idx < 0 {
+			merged.Content = append(merged.Content, key, val)
+			continue
+		}
+
+		// Higher-priority source's casing wins on a case-insensitive match.
+		merged.Content[idx] = key
+
+		n, err := m.mergeNode(merged.Content[idx+1], val)
+		if err != nil {
+			return nil, err
+		}
+		merged.Content[idx+1] = n
+	}
+
+	return merged, nil
+}
+
+// mergeSequenceNode merges sequence node `from` into sequence node `into`
+// according to strategy.
+func (m Merger) mergeSequenceNode(into, from *yaml.Node, strategy SeqStrategy) (*yaml.Node, error) {
+	switch strategy.Mode {
+	case SeqAppend:
+		merged := cloneNode(into)
+		merged.Content = append(merged.Content, from.Content...)
+		return merged, nil
+	case SeqPrepend:
+		merged := cloneNode(from)
+		merged.Content = append(append([]*yaml.Node(nil), from.Content...), into.Content...)
+		return merged, nil
+	case SeqUnique:
+		merged := cloneNode(into)
+		merged.Content = append(merged.Content, from.Content...)
+		return dedupeSequence(merged), nil
+	case SeqKeyedMerge:
+		return m.mergeKeyedSequence(into, from, strategy.Key)
+	default:
+		return from, nil
+	}
+}
+
+// mergeKeyedSequence treats into and from as collections of mappings keyed
+// by key, deep-merging entries whose key matches and appending the rest.
+func (m Merger) mergeKeyedSequence(into, from *yaml.Node, key string) (*yaml.Node, error) {
+	merged := cloneNode(into)
+
+	for _, item := range from.Content {
+		idx := findKeyedItem(merged.Content, key, item, m.CaseInsensitive)
+		if idx < 0 {
+			merged.Content = append(merged.Content, item)
+			continue
+		}
+
+		if merged.Content[idx].Kind != yaml.MappingNode || item.Kind != yaml.MappingNode {
+			merged.Content[idx] = item
+			continue
+		}
+
+		nested := Merger{Strict: m.Strict, CaseInsensitive: m.CaseInsensitive, SeqStrategy: m.SeqStrategy}
+		n, err := nested.mergeMappingNode(merged.Content[idx], item)
+		if err != nil {
+			return nil, err
+		}
+		merged.Content[idx] = n
+	}
+
+	return merged, nil
+}
+
+// findKeyedItem returns the index in items of the mapping whose key field
+// matches target's, or -1 if there is no such mapping.
+func findKeyedItem(items []*yaml.Node, key string, target *yaml.Node, ci bool) int {
+	if target.Kind != yaml.MappingNode {
+		return -1
+	}
+	targetIdx := findKey(target, key, ci)
+	if targetIdx < 0 {
+		return -1
+	}
+	want := target.Content[targetIdx+1].Value
+
+	for i, item := range items {
+		if item.Kind != yaml.MappingNode {
+			continue
+		}
+		itemIdx := findKey(item, key, ci)
+		if itemIdx >= 0 && item.Content[itemIdx+1].Value == want {
+			return i
+		}
+	}
+	return -1
+}
+
+// findKey returns the index of key's value within mapping node m's Content,
+// or -1 if the key isn't present. When ci is set, the comparison ignores case.
+func findKey(m *yaml.Node, key string, ci bool) int {
+	for i := 0; i < len(m.Content); i += 2 {
+		if m.Content[i].Value == key || (ci && strings.EqualFold(m.Content[i].Value, key)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// dedupeSequence drops items from n.Content that are deep-equal to an
+// earlier item, preserving order.
+func dedupeSequence(n *yaml.Node) *yaml.Node {
+	deduped := make([]*yaml.Node, 0, len(n.Content))
+	for _, item := range n.Content {
+		dup := false
+		for _, existing := range deduped {
+			if nodesEqual(existing, item) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			deduped = append(deduped, item)
+		}
+	}
+	n.Content = deduped
+	return n
+}
+
+// nodesEqual reports whether a and b represent the same YAML value.
+func nodesEqual(a, b *yaml.Node) bool {
+	if a.Kind != b.Kind {
+		return false
+	}
+	if a.Kind != yaml.SequenceNode && a.Kind != yaml.MappingNode {
+		return a.Tag == b.Tag && a.Value == b.Value
+	}
+	if len(a.Content) != len(b.Content) {
+		return false
+	}
+	for i := range a.Content {
+		if !nodesEqual(a.Content[i], b.Content[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// cloneNode returns a shallow copy of n with its own Content slice, so that
+// appending to the clone doesn't mutate n.
+func cloneNode(n *yaml.Node) *yaml.Node {
+	clone := *n
+	clone.Content = append([]*yaml.Node(nil), n.Content...)
+	return &clone
+}
+
+// CheckDuplicateKeys walks n looking for mapping nodes with a repeated key,
+// mirroring the error that decoding straight into a Go map used to raise.
+// When m.CaseInsensitive is set, keys that differ only in case are also
+// treated as duplicates, but only raise an error when m.Strict is set.
+func (m Merger) CheckDuplicateKeys(n *yaml.Node) error {
+	return checkDuplicateKeys(n, m.CaseInsensitive, m.Strict)
+}
+
+func checkDuplicateKeys(n *yaml.Node, ci, strict bool) error {
+	if n.Kind == yaml.MappingNode {
+		seen := make(map[string]*yaml.Node, len(n.Content)/2) // normalized key -> earlier key node
+		for i := 0; i < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			norm := key
+			if ci {
+				norm = strings.ToLower(key)
+			}
+			if orig, ok := seen[norm]; ok {
+				if orig.Value == key {
+					return fmt.Errorf("mapping key %q already defined at line %d", key, orig.Line)
+				}
+				if strict {
+					return fmt.Errorf("mapping keys %q and %q already defined at line %d differ only in case", orig.Value, key, orig.Line)
+				}
+			}
+			seen[norm] = n.Content[i]
+		}
+	}
+
+	for _, c := range n.Content {
+		if err := checkDuplicateKeys(c, ci, strict); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isNullNode reports whether n is an explicit YAML null scalar.
+func isNullNode(n *yaml.Node) bool {
+	return n.Kind == yaml.ScalarNode && n.Tag == "!!null"
+}
+
+// describeNode describes the kind of YAML node n represents.
+func describeNode(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return "mapping"
+	case yaml.SequenceNode:
+		return "sequence"
+	default:
+		return "scalar"
+	}
+}
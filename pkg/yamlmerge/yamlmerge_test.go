@@ -0,0 +1,333 @@
+// Copyright (c) 2024 Firefly Consulting Ltd.
+// Portions Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package yamlmerge
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestMergeReaders(t *testing.T) {
+
+	testcases := []struct {
+		name          string
+		input1        string
+		input2        string
+		expectError   bool
+		errorContains string
+		strict        bool
+		ci            bool
+		seq           string
+		docMode       string
+		output        interface{}
+	}{
+		{
+			name:        "merge simple maps",
+			input1:      `{"one": 1, "two": 2}`,
+			input2:      `{"one": 42, "three": 3}`,
+			expectError: false,
+			output: map[string]interface{}{
+				"one":   42,
+				"two":   2,
+				"three": 3,
+			},
+		},
+		{
+			name:        "merge simple sequences",
+			input1:      `{"foo": [1, 2, 3]}`,
+			input2:      `{"foo": [4, 5, 6]}`,
+			expectError: false,
+			output: map[string]interface{}{
+				"foo": []interface{}{
+					4, 5, 6,
+				},
+			},
+		},
+		{
+			name: "test n",
+			// Assert that this value is treated as string and not boolean false
+			input1:      `marker: n`,
+			input2:      ``,
+			expectError: false,
+			output: map[string]interface{}{
+				"marker": "n",
+			},
+		},
+		{
+			name:          "duplicate key",
+			input1:        `{"one": 1, "two": 2, "one": 99}`,
+			input2:        `{"one": 42, "three": 3}`,
+			expectError:   true,
+			errorContains: "already defined",
+		},
+		{
+			name:        "non-strict",
+			input1:      `{"one": 1, "two": 2}`,
+			input2:      `{"one": [1, 2], "three": 3}`,
+			expectError: false,
+			output: map[string]interface{}{
+				"one": []interface{}{
+					1,
+					2,
+				},
+				"two":   2,
+				"three": 3,
+			},
+		},
+		{
+			name:          "strict",
+			input1:        `{"one": 1, "two": 2}`,
+			input2:        `{"one": [1, 2], "three": 3}`,
+			strict:        true,
+			expectError:   true,
+			errorContains: "can't merge a sequence into a scalar",
+		},
+		{
+			name:          "input-error",
+			input1:        `{"one": 1, "two": 2`,
+			input2:        `{"one": [1, 2], "three": 3}`,
+			expectError:   true,
+			errorContains: "couldn't decode source",
+		},
+		{
+			name:   "empty inputs",
+			input1: ``,
+			input2: ``,
+			output: nil,
+		},
+		{
+			name:   "first input empty",
+			input1: ``,
+			input2: `{"one": 1, "two": 2}`,
+			output: map[string]interface{}{
+				"one": 1,
+				"two": 2,
+			},
+		},
+		{
+			name:   "second input empty",
+			input1: `{"one": 1, "two": 2}`,
+			input2: ``,
+			output: map[string]interface{}{
+				"one": 1,
+				"two": 2,
+			},
+		},
+		{
+			name:        "null value",
+			input1:      `{"one": 1, "two": 2}`,
+			input2:      `{"one": 42, "two": null}`,
+			expectError: false,
+			output: map[string]interface{}{
+				"one": 42,
+				"two": nil,
+			},
+		},
+		{
+			name:        "seq append",
+			input1:      `{"foo": [1, 2, 3]}`,
+			input2:      `{"foo": [4, 5, 6]}`,
+			expectError: false,
+			seq:         "append",
+			output: map[string]interface{}{
+				"foo": []interface{}{1, 2, 3, 4, 5, 6},
+			},
+		},
+		{
+			name:        "seq prepend",
+			input1:      `{"foo": [1, 2, 3]}`,
+			input2:      `{"foo": [4, 5, 6]}`,
+			expectError: false,
+			seq:         "prepend",
+			output: map[string]interface{}{
+				"foo": []interface{}{4, 5, 6, 1, 2, 3},
+			},
+		},
+		{
+			name:        "seq unique",
+			input1:      `{"foo": [1, 2, 3]}`,
+			input2:      `{"foo": [2, 3, 4]}`,
+			expectError: false,
+			seq:         "unique",
+			output: map[string]interface{}{
+				"foo": []interface{}{1, 2, 3, 4},
+			},
+		},
+		{
+			name:        "seq merge-by key",
+			input1:      `{"foo": [{"name": "a", "value": 1}, {"name": "b", "value": 2}]}`,
+			input2:      `{"foo": [{"name": "b", "value": 3}, {"name": "c", "value": 4}]}`,
+			expectError: false,
+			seq:         "merge-by:name",
+			output: map[string]interface{}{
+				"foo": []interface{}{
+					map[string]interface{}{"name": "a", "value": 1},
+					map[string]interface{}{"name": "b", "value": 3},
+					map[string]interface{}{"name": "c", "value": 4},
+				},
+			},
+		},
+		{
+			// A nested sequence under a merge-by-matched item must honor the
+			// document-wide seq strategy, not silently fall back to replace:
+			// since "tags" holds scalars (not key-matchable mappings), the
+			// merge-by strategy degrades to appending every item, so "x" and
+			// "y" both survive instead of "y" replacing "x".
+			name:        "seq merge-by key honors nested seq strategy",
+			input1:      `{"foo": [{"name": "a", "tags": ["x"]}]}`,
+			input2:      `{"foo": [{"name": "a", "tags": ["y"]}]}`,
+			expectError: false,
+			seq:         "merge-by:name",
+			output: map[string]interface{}{
+				"foo": []interface{}{
+					map[string]interface{}{"name": "a", "tags": []interface{}{"x", "y"}},
+				},
+			},
+		},
+		{
+			name:        "seq per-node tag override",
+			input1:      `{"foo": [1, 2, 3]}`,
+			input2:      "foo: !merge:append [4, 5, 6]",
+			expectError: false,
+			output: map[string]interface{}{
+				"foo": []interface{}{1, 2, 3, 4, 5, 6},
+			},
+		},
+		{
+			name:        "seq per-node comment directive override",
+			input1:      `{"foo": [1, 2, 3]}`,
+			input2:      "foo: [4, 5, 6] # merge:append",
+			expectError: false,
+			output: map[string]interface{}{
+				"foo": []interface{}{1, 2, 3, 4, 5, 6},
+			},
+		},
+		{
+			name:        "multi-document stream merge mode",
+			input1:      "a: 1\n---\nb: 2",
+			input2:      ``,
+			expectError: false,
+			output: map[string]interface{}{
+				"a": 1,
+				"b": 2,
+			},
+		},
+		{
+			name:        "multi-document stream first mode",
+			input1:      "a: 1\n---\nb: 2",
+			input2:      ``,
+			docMode:     "first",
+			expectError: false,
+			output: map[string]interface{}{
+				"a": 1,
+			},
+		},
+		{
+			name:        "case-insensitive merge",
+			input1:      `{"One": 1, "Two": 2}`,
+			input2:      `{"one": 42, "three": 3}`,
+			ci:          true,
+			expectError: false,
+			output: map[string]interface{}{
+				"one":   42,
+				"Two":   2,
+				"three": 3,
+			},
+		},
+		{
+			name:          "case-insensitive duplicate keys strict",
+			input1:        `{"One": 1, "one": 2}`,
+			input2:        `{}`,
+			ci:            true,
+			strict:        true,
+			expectError:   true,
+			errorContains: "differ only in case",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			seq, err := ParseSeqStrategy(tc.seq)
+			require.NoError(t, err)
+			doc, err := ParseDocMode(tc.docMode)
+			require.NoError(t, err)
+
+			m := Merger{Strict: tc.strict, CaseInsensitive: tc.ci, SeqStrategy: seq, DocMode: doc}
+			got, err := m.MergeReaders(strings.NewReader(tc.input1), strings.NewReader(tc.input2))
+			if tc.expectError {
+				require.ErrorContains(t, err, tc.errorContains)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.output, got)
+			}
+		})
+	}
+}
+
+func TestMergeReadersDocModeStream(t *testing.T) {
+	m := Merger{DocMode: DocModeStream}
+	got, err := m.MergeReaders(
+		strings.NewReader("name: a\nvalue: 1\n---\nname: b\nvalue: 1"),
+		strings.NewReader("value: 2"),
+	)
+	require.NoError(t, err)
+
+	require.Equal(t, []interface{}{
+		map[string]interface{}{"name": "a", "value": 2},
+		map[string]interface{}{"name": "b", "value": 2},
+	}, got)
+}
+
+func TestMerge(t *testing.T) {
+	m := Merger{}
+	got, err := m.Merge(
+		map[string]interface{}{"one": 1, "two": 2},
+		map[string]interface{}{"one": 42, "three": 3},
+	)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{
+		"one":   42,
+		"two":   2,
+		"three": 3,
+	}, got)
+}
+
+func TestMergeNodes(t *testing.T) {
+	decode := func(s string) *yaml.Node {
+		var n yaml.Node
+		require.NoError(t, yaml.Unmarshal([]byte(s), &n))
+		return &n
+	}
+
+	m := Merger{SeqStrategy: SeqStrategy{Mode: SeqAppend}}
+	merged, err := m.MergeNodes(decode(`{"foo": [1, 2]}`), decode(`{"foo": [3, 4]}`))
+	require.NoError(t, err)
+
+	var got interface{}
+	require.NoError(t, merged.Decode(&got))
+	require.Equal(t, map[string]interface{}{
+		"foo": []interface{}{1, 2, 3, 4},
+	}, got)
+}